@@ -1,19 +1,19 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"time"
 
-	"gopkg.in/irc.v3"
+	"github.com/arachnist/notbot/presence"
 )
 
 type atMonitor struct {
-	previousUserList []string
-	channel          string
-	apiAddress       string
+	channel    string
+	apiAddress string
 }
 
 type atUsers struct {
@@ -40,71 +40,73 @@ func (a *atResponse) UserList() (ret []string) {
 
 func (a *atResponse) UserListZWS() (ret []string) {
 	for _, user := range a.Users {
-		login := user.Login[:1] + "\u200B" + user.Login[1:]
+		login := user.Login[:1] + "​" + user.Login[1:]
 		ret = append(ret, login)
 	}
 
 	return ret
 }
 
-func (a *atMonitor) Run(c *irc.Client, done chan bool) {
-	ticker := time.NewTicker(10 * time.Second)
-
-	for {
-		select {
-		case <-done:
-			return
-		case <-ticker.C:
-			var diffText string
-			atHS, err := a.at()
-
-			if err != nil {
-				log.Println(err)
-				break
-			}
+func (a *atMonitor) stateKey() string {
+	return "at." + a.channel
+}
 
-			current := atHS.UserListZWS()
+// atSource fetches the checkinator presence list for a presence.Tracker.
+type atSource struct {
+	apiAddress string
+}
 
-			arrived := listSubtract(current, a.previousUserList)
-			left := listSubtract(a.previousUserList, current)
-			alsoThere := listSubtract(a.previousUserList, left)
+func (s atSource) Fetch(ctx context.Context) ([]string, error) {
+	data, err := httpGet(s.apiAddress)
+	if err != nil {
+		return nil, fmt.Errorf("unable to access checkinator api: %w", err)
+	}
 
-			if len(arrived) > 0 {
-				diffText = fmt.Sprint(" arrived: ", arrived)
-			}
+	var values atResponse
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, fmt.Errorf("unable to decode checkinator response: %w", err)
+	}
 
-			if len(left) > 0 {
-				diffText += fmt.Sprint(" left: ", left)
-			}
+	return values.UserListZWS(), nil
+}
 
-			if len(diffText) > 0 {
-				if len(alsoThere) > 0 {
-					diffText += fmt.Sprint(" also there: ", alsoThere)
-				}
+func (a *atMonitor) Run(n Notifier, done chan bool) {
+	tracker := presence.New(a.channel, atSource{apiAddress: a.apiAddress}, n, 10*time.Second, presenceDebounce)
 
-				msg := fmt.Sprintf("NOTICE %s :%s\n", a.channel, diffText)
-				log.Println(diffText)
-				c.Write(msg)
-				a.previousUserList = current
+	if state != nil {
+		if raw, ok := state.Retrieve(a.stateKey()); ok {
+			var previous []string
+			if err := json.Unmarshal(raw, &previous); err != nil {
+				log.Println("at: decoding previous state:", err)
+			} else {
+				tracker.Seed(previous)
 			}
 		}
 	}
-}
-
-func (a *atMonitor) at() (at atResponse, err error) {
-	var values atResponse = atResponse{}
 
-	data, err := httpGet(a.apiAddress)
-	if err != nil {
-		return values, fmt.Errorf("Unable to access checkinator api:", err)
+	tracker.OnError = func(err error) {
+		log.Println("at:", err)
 	}
 
-	err = json.Unmarshal(data, &values)
-	if err != nil {
-		return values, fmt.Errorf("Unable to decode checkinator response:", err)
+	tracker.OnTick = func(current []string) {
+		aggregate.set(a.channel, current)
+
+		if state != nil {
+			if raw, err := json.Marshal(current); err != nil {
+				log.Println("at: encoding state:", err)
+			} else {
+				state.Store(a.stateKey(), raw)
+			}
+		}
 	}
 
-	return values, nil
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-done
+		cancel()
+	}()
+
+	tracker.Run(ctx)
 }
 
 var (
@@ -0,0 +1,117 @@
+// Package brain is a small goroutine-owned key/value store monitors use to
+// persist their state across restarts.
+package brain
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+type storeRequest struct {
+	name  string
+	value json.RawMessage
+}
+
+type retrieveRequest struct {
+	name  string
+	reply chan retrieveResponse
+}
+
+type retrieveResponse struct {
+	value json.RawMessage
+	ok    bool
+}
+
+// Brain owns a map[string]json.RawMessage behind a single goroutine, so
+// callers never need their own locks.
+type Brain struct {
+	path     string
+	store    chan storeRequest
+	retrieve chan retrieveRequest
+	shutdown chan chan struct{}
+}
+
+// New starts a Brain backed by path. If path already holds a previous
+// dump it's loaded before the owning goroutine starts serving requests;
+// a missing file is not an error.
+func New(path string) (*Brain, error) {
+	data := map[string]json.RawMessage{}
+
+	raw, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(raw, &data); err != nil {
+			return nil, fmt.Errorf("decoding brain state from %s: %w", path, err)
+		}
+	case os.IsNotExist(err):
+		// nothing to load yet
+	default:
+		return nil, fmt.Errorf("reading brain state from %s: %w", path, err)
+	}
+
+	b := &Brain{
+		path:     path,
+		store:    make(chan storeRequest),
+		retrieve: make(chan retrieveRequest),
+		shutdown: make(chan chan struct{}),
+	}
+
+	go b.run(data)
+
+	return b, nil
+}
+
+func (b *Brain) run(data map[string]json.RawMessage) {
+	for {
+		select {
+		case req := <-b.store:
+			data[req.name] = req.value
+			if err := b.persist(data); err != nil {
+				fmt.Fprintln(os.Stderr, "brain: persisting state:", err)
+			}
+		case req := <-b.retrieve:
+			value, ok := data[req.name]
+			req.reply <- retrieveResponse{value: value, ok: ok}
+		case done := <-b.shutdown:
+			close(done)
+			return
+		}
+	}
+}
+
+// Store saves value under name and persists the whole map to disk.
+func (b *Brain) Store(name string, value json.RawMessage) {
+	b.store <- storeRequest{name: name, value: value}
+}
+
+// Retrieve reports the raw value last stored under name, and whether it
+// was present at all.
+func (b *Brain) Retrieve(name string) (value json.RawMessage, ok bool) {
+	reply := make(chan retrieveResponse)
+	b.retrieve <- retrieveRequest{name: name, reply: reply}
+	resp := <-reply
+
+	return resp.value, resp.ok
+}
+
+// Shutdown stops the owning goroutine, blocking until it has exited.
+func (b *Brain) Shutdown() {
+	done := make(chan struct{})
+	b.shutdown <- done
+	<-done
+}
+
+func (b *Brain) persist(data map[string]json.RawMessage) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	tmp := b.path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0o600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, b.path)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"gopkg.in/irc.v3"
+)
+
+var (
+	tlsEnabled    bool
+	tlsCertFile   string
+	tlsKeyFile    string
+	tlsInsecure   bool
+	saslMechanism string
+	saslUser      string
+	saslPass      string
+)
+
+func init() {
+	flag.BoolVar(&tlsEnabled, "tls", false, "Connect to the server over TLS")
+	flag.StringVar(&tlsCertFile, "tls.cert", "", "Client certificate to present, for TLS and SASL EXTERNAL")
+	flag.StringVar(&tlsKeyFile, "tls.key", "", "Key matching -tls.cert")
+	flag.BoolVar(&tlsInsecure, "tls.insecure", false, "Skip verification of the server's TLS certificate")
+	flag.StringVar(&saslMechanism, "sasl.mechanism", "", "SASL mechanism to authenticate with (PLAIN or EXTERNAL); empty disables SASL")
+	flag.StringVar(&saslUser, "sasl.user", "", "SASL PLAIN username")
+	flag.StringVar(&saslPass, "sasl.pass", "", "SASL PLAIN password")
+
+	Dispatchers.Add(capDispatcher)
+}
+
+// requestedCapabilities are the capabilities offered during CAP LS; any
+// the server doesn't advertise are simply left unrequested.
+var requestedCapabilities = []string{
+	"sasl",
+	"server-time",
+	"message-tags",
+	"echo-message",
+	"away-notify",
+	"account-notify",
+	"extended-join",
+}
+
+// dial opens the connection notbot will register over. A server written as
+// ircs://host:port or host:port+tls implies TLS regardless of -tls, mirroring
+// the connection string conventions clients like senpai already accept.
+func dial(server string) (net.Conn, error) {
+	addr := server
+	wantTLS := tlsEnabled
+
+	switch {
+	case strings.HasPrefix(addr, "ircs://"):
+		addr = strings.TrimPrefix(addr, "ircs://")
+		wantTLS = true
+	case strings.HasSuffix(addr, "+tls"):
+		addr = strings.TrimSuffix(addr, "+tls")
+		wantTLS = true
+	}
+
+	if !wantTLS {
+		return net.Dial("tcp", addr)
+	}
+
+	config := &tls.Config{InsecureSkipVerify: tlsInsecure}
+
+	if tlsCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(tlsCertFile, tlsKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading TLS client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return tls.Dial("tcp", addr, config)
+}
+
+// capDispatcher drives CAP negotiation and, when -sasl.mechanism is set,
+// SASL authentication, finishing with CAP END. It's a Dispatchers entry
+// like logger and joiner, so it sees every line the client reads.
+func capDispatcher(c *irc.Client, m *irc.Message) {
+	switch m.Command {
+	case "CAP":
+		handleCap(c, m)
+	case "AUTHENTICATE":
+		handleAuthenticate(c, m)
+	case "903":
+		log.Println("SASL authentication succeeded")
+		c.Write("CAP END")
+	case "904", "905":
+		log.Println("SASL authentication failed:", lastParam(m))
+		c.Write("CAP END")
+	}
+}
+
+// capLSBuffer accumulates capabilities across a CAP LS 302 response split
+// over multiple lines, keyed by the "*" continuation parameter servers send
+// between "LS" and the capability list on every line but the last.
+var capLSBuffer []string
+
+func handleCap(c *irc.Client, m *irc.Message) {
+	if len(m.Params) < 2 {
+		return
+	}
+
+	switch m.Params[1] {
+	case "LS":
+		for _, capb := range strings.Fields(lastParam(m)) {
+			// CAP LS 302 may attach a value, as in sasl=PLAIN,EXTERNAL.
+			if i := strings.IndexByte(capb, '='); i >= 0 {
+				capb = capb[:i]
+			}
+			capLSBuffer = append(capLSBuffer, capb)
+		}
+
+		if len(m.Params) >= 3 && m.Params[2] == "*" {
+			// More lines to come; wait for the final one before deciding
+			// what to request.
+			return
+		}
+
+		offered := capLSBuffer
+		capLSBuffer = nil
+
+		var want []string
+		for _, capb := range requestedCapabilities {
+			if capb == "sasl" && saslMechanism == "" {
+				continue
+			}
+			if containsString(offered, capb) {
+				want = append(want, capb)
+			}
+		}
+
+		if len(want) == 0 {
+			c.Write("CAP END")
+			return
+		}
+
+		c.Write("CAP REQ :" + strings.Join(want, " "))
+	case "ACK":
+		if saslMechanism != "" && containsString(strings.Fields(lastParam(m)), "sasl") {
+			c.Write("AUTHENTICATE " + strings.ToUpper(saslMechanism))
+			return
+		}
+		c.Write("CAP END")
+	case "NAK":
+		log.Println("Server rejected capabilities:", lastParam(m))
+		c.Write("CAP END")
+	}
+}
+
+func handleAuthenticate(c *irc.Client, m *irc.Message) {
+	switch strings.ToUpper(saslMechanism) {
+	case "EXTERNAL":
+		c.Write("AUTHENTICATE +")
+	case "PLAIN":
+		payload := []byte("\x00" + saslUser + "\x00" + saslPass)
+		c.Write("AUTHENTICATE " + base64.StdEncoding.EncodeToString(payload))
+	}
+}
+
+func lastParam(m *irc.Message) string {
+	if len(m.Params) == 0 {
+		return ""
+	}
+	return m.Params[len(m.Params)-1]
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -7,22 +7,6 @@ import (
 	"time"
 )
 
-func listSubstract(a, b []string) (ret []string) {
-	mb := make(map[string]bool, len(b))
-
-	for _, x := range b {
-		mb[x] = true
-	}
-
-	for _, x := range a {
-		if _, found := mb[x]; !found {
-			ret = append(ret, x)
-		}
-	}
-
-	return ret
-}
-
 func httpGet(link string) ([]byte, error) {
 	var buf []byte
 	tr := &http.Transport{
@@ -1,18 +1,21 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"encoding/xml"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"strings"
 	"time"
 
+	"github.com/arachnist/notbot/presence"
 	"golang.org/x/net/websocket"
-	"gopkg.in/irc.v3"
 )
 
-const pingFrame = "<iq type='get'><ping xmlns='urn:xmpp:ping'/>"
+const pingFrame = "<iq type='get'><ping xmlns='urn:xmpp:ping'/></iq>"
 
 var (
 	jitsiChannels arrayFlags
@@ -68,6 +71,91 @@ type JitsiPresence struct {
 	} `xml:"x"`
 }
 
+// jitsiMessage and jitsiIQ are decoded just enough to log them.
+type jitsiMessage struct {
+	XMLName xml.Name `xml:"message"`
+	From    string   `xml:"from,attr"`
+	Type    string   `xml:"type,attr"`
+	Body    string   `xml:"body"`
+}
+
+type jitsiIQ struct {
+	XMLName xml.Name `xml:"iq"`
+	From    string   `xml:"from,attr"`
+	ID      string   `xml:"id,attr"`
+	Type    string   `xml:"type,attr"`
+}
+
+// joinPresence is the outgoing MUC join frame.
+type joinPresence struct {
+	XMLName xml.Name `xml:"jabber:client presence"`
+	To      string   `xml:"to,attr"`
+	X       struct {
+		XMLName xml.Name `xml:"http://jabber.org/protocol/muc x"`
+	} `xml:"x"`
+	StatsID                   string      `xml:"stats-id"`
+	Region                    jitsiRegion `xml:"region"`
+	C                         jitsiCaps   `xml:"c"`
+	JitsiParticipantRegion    string      `xml:"jitsi_participant_region"`
+	Videomuted                bool        `xml:"videomuted"`
+	Audiomuted                bool        `xml:"audiomuted"`
+	JitsiParticipantCodecType string      `xml:"jitsi_participant_codecType"`
+	Nick                      jitsiNick   `xml:"nick"`
+}
+
+type jitsiRegion struct {
+	XMLName xml.Name `xml:"http://jitsi.org/jitsi-meet region"`
+	ID      string   `xml:"id,attr"`
+}
+
+type jitsiCaps struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/caps c"`
+	Hash    string   `xml:"hash,attr"`
+	Node    string   `xml:"node,attr"`
+	Ver     string   `xml:"ver,attr"`
+}
+
+type jitsiNick struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/nick nick"`
+	Text    string   `xml:",chardata"`
+}
+
+type openFrame struct {
+	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-framing open"`
+	To      string   `xml:"to,attr"`
+	Version string   `xml:"version,attr"`
+}
+
+type authFrame struct {
+	XMLName   xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-sasl auth"`
+	Mechanism string   `xml:"mechanism,attr"`
+}
+
+type bindIQ struct {
+	XMLName xml.Name `xml:"jabber:client iq"`
+	ID      string   `xml:"id,attr"`
+	Type    string   `xml:"type,attr"`
+	Bind    struct {
+		XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-bind bind"`
+	} `xml:"bind"`
+}
+
+type sessionIQ struct {
+	XMLName xml.Name `xml:"jabber:client iq"`
+	ID      string   `xml:"id,attr"`
+	Type    string   `xml:"type,attr"`
+	Session struct {
+		XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-session session"`
+	} `xml:"session"`
+}
+
+// jitsiSession tracks one connection's handshake state.
+type jitsiSession struct {
+	boundJID string
+	roomJID  string
+	focusJID string
+}
+
 type JitsiClient struct {
 	nick       string
 	server     string
@@ -75,6 +163,44 @@ type JitsiClient struct {
 	ircChannel string
 	done       chan bool
 	users      map[string]string // map[jid]nick
+	focusNick  string            // current brewery/focus occupant, if known
+	session    jitsiSession
+	tracker    *presence.Tracker
+}
+
+// jitsiSource reports the room's current occupants to a presence.Tracker.
+// It's never polled on a timer; handlePresence calls tracker.Tick itself
+// right after a user joins or leaves. A nickname change updates j.users
+// without a tick.
+type jitsiSource struct {
+	client *JitsiClient
+}
+
+func (s jitsiSource) Fetch(ctx context.Context) ([]string, error) {
+	names := make([]string, 0, len(s.client.users))
+	for _, nick := range s.client.users {
+		names = append(names, nick[:1]+"​"+nick[1:])
+	}
+
+	return names, nil
+}
+
+func (j *JitsiClient) stateKey() string {
+	return "jitsi." + j.server + "." + j.room
+}
+
+func (j *JitsiClient) persistUsers() {
+	if state == nil {
+		return
+	}
+
+	raw, err := json.Marshal(j.users)
+	if err != nil {
+		log.Println("JitsiClient", j.server, j.room, "Error encoding state", err)
+		return
+	}
+
+	state.Store(j.stateKey(), raw)
 }
 
 func (j *JitsiClient) KeepAlive(ws *websocket.Conn) {
@@ -91,27 +217,79 @@ func (j *JitsiClient) KeepAlive(ws *websocket.Conn) {
 	}
 }
 
-func (j *JitsiClient) Run(c *irc.Client, done chan bool) {
-	var msg = make([]byte, 64*1024)
+// send marshals v and writes it to ws.
+func (j *JitsiClient) send(ws *websocket.Conn, v interface{}) error {
+	data, err := xml.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	_, err = ws.Write(data)
+	return err
+}
+
+// breweryJID is the focus/brewery MUC jicofo uses to coordinate the conference.
+func (j *JitsiClient) breweryJID() string {
+	return j.room + "@focus." + j.server
+}
 
+func (j *JitsiClient) roomJID() string {
+	return j.room + "@conference." + j.server
+}
+
+// join (re)joins both the conference MUC and the brewery/focus MUC.
+func (j *JitsiClient) join(ws *websocket.Conn) error {
+	j.session.roomJID = j.roomJID()
+	j.session.focusJID = j.breweryJID()
+
+	room := joinPresence{
+		To:                        j.session.roomJID + "/" + j.nick,
+		StatsID:                   "Joy-4gA",
+		Region:                    jitsiRegion{ID: "ffmuc-de1"},
+		C:                         jitsiCaps{Hash: "sha-1", Node: "https://jitsi.org/jitsi-meet", Ver: "ZjoRESHG8S3zyis9xCdYpFmbThk="},
+		JitsiParticipantRegion:    "ffmuc-de1",
+		Videomuted:                true,
+		Audiomuted:                true,
+		JitsiParticipantCodecType: "",
+		Nick:                      jitsiNick{Text: j.nick},
+	}
+	if err := j.send(ws, room); err != nil {
+		return fmt.Errorf("joining conference MUC: %w", err)
+	}
+
+	brewery := joinPresence{
+		To:   j.session.focusJID + "/" + j.nick,
+		Nick: jitsiNick{Text: j.nick},
+	}
+	if err := j.send(ws, brewery); err != nil {
+		return fmt.Errorf("joining brewery MUC: %w", err)
+	}
+
+	return nil
+}
+
+func (j *JitsiClient) Run(n Notifier, done chan bool) {
 	origin := "https://" + j.server
 	url := "wss://" + j.server + "/xmpp-websocket?room=" + j.room
 	protocol := "xmpp"
-	var initFrames = []string{
-		"<open to=\"" + j.server + "\" version=\"1.0\" xmlns=\"urn:ietf:params:xml:ns:xmpp-framing\"/>",
-		"<auth mechanism=\"ANONYMOUS\" xmlns=\"urn:ietf:params:xml:ns:xmpp-sasl\"/>",
-		"<open to=\"" + j.server + "\" version=\"1.0\" xmlns=\"urn:ietf:params:xml:ns:xmpp-framing\"/>",
-		"<iq id=\"_bind_auth_2\" type=\"set\" xmlns=\"jabber:client\"><bind xmlns=\"urn:ietf:params:xml:ns:xmpp-bind\"/></iq>",
-		"<iq id=\"_session_auth_2\" type=\"set\" xmlns=\"jabber:client\"><session xmlns=\"urn:ietf:params:xml:ns:xmpp-session\"/></iq>",
-		"<presence to=\"" + j.room + "@conference." + j.server + "/3344bf4a\" xmlns=\"jabber:client\"><x xmlns=\"http://jabber.org/protocol/muc\"/>" +
-			"<stats-id>Joy-4gA</stats-id><region id=\"ffmuc-de1\" xmlns=\"http://jitsi.org/jitsi-meet\"/>" +
-			"<c hash=\"sha-1\" node=\"https://jitsi.org/jitsi-meet\" ver=\"ZjoRESHG8S3zyis9xCdYpFmbThk=\" xmlns=\"http://jabber.org/protocol/caps\"/>" +
-			"<jitsi_participant_region>ffmuc-de1</jitsi_participant_region><videomuted>true</videomuted><audiomuted>true</audiomuted>" +
-			"<jitsi_participant_codecType></jitsi_participant_codecType><nick xmlns=\"http://jabber.org/protocol/nick\">" + j.nick + "</nick></presence>",
-	}
-	
+
 	j.users = make(map[string]string)
 
+	if state != nil {
+		if raw, ok := state.Retrieve(j.stateKey()); ok {
+			if err := json.Unmarshal(raw, &j.users); err != nil {
+				log.Println("JitsiClient", j.server, j.room, "Error decoding previous state", err)
+				j.users = make(map[string]string)
+			}
+		}
+	}
+
+	source := jitsiSource{client: j}
+	j.tracker = presence.New(j.ircChannel, source, n, 0, presenceDebounce)
+	if seeded, err := source.Fetch(context.Background()); err == nil {
+		j.tracker.Seed(seeded)
+	}
+
 	for {
 		log.Println("JitsiClient", j.server, j.room, "Initializing")
 
@@ -121,74 +299,183 @@ func (j *JitsiClient) Run(c *irc.Client, done chan bool) {
 			goto reconnect
 		}
 
-		for n, frame := range initFrames {
-			if _, err := ws.Write([]byte(frame)); err != nil {
-				log.Println("JitsiClient", j.server, j.room, "Error sending initialization frame", n, err)
-				goto reconnect
-			}
+		if err := j.send(ws, openFrame{To: j.server, Version: "1.0"}); err != nil {
+			log.Println("JitsiClient", j.server, j.room, "Error opening stream", err)
+			goto reconnect
+		}
+		if err := j.send(ws, authFrame{Mechanism: "ANONYMOUS"}); err != nil {
+			log.Println("JitsiClient", j.server, j.room, "Error sending auth", err)
+			goto reconnect
+		}
+		if err := j.send(ws, openFrame{To: j.server, Version: "1.0"}); err != nil {
+			log.Println("JitsiClient", j.server, j.room, "Error re-opening stream", err)
+			goto reconnect
+		}
+		if err := j.send(ws, bindIQ{ID: "_bind_auth_2", Type: "set"}); err != nil {
+			log.Println("JitsiClient", j.server, j.room, "Error binding resource", err)
+			goto reconnect
+		}
+		if err := j.send(ws, sessionIQ{ID: "_session_auth_2", Type: "set"}); err != nil {
+			log.Println("JitsiClient", j.server, j.room, "Error starting session", err)
+			goto reconnect
+		}
+		if err := j.join(ws); err != nil {
+			log.Println("JitsiClient", j.server, j.room, err)
+			goto reconnect
 		}
 
 		log.Println("JitsiClient", j.server, j.room, "Running")
 		go j.KeepAlive(ws)
-		for {
-			select {
-			case <-done:
-				log.Println("JitsiClient", j.server, j.room, "Shutting down")
+
+		if err := j.readStanzas(ws, n, done); err != nil {
+			if err != errJitsiShutdown {
+				log.Println("JitsiClient", j.server, j.room, "Error while reading stanzas", err)
+			} else {
 				return
-			default:
-				_, err := ws.Read(msg)
-				v := JitsiPresence{}
+			}
+		}
 
-				if err != nil {
-					log.Println("JitsiClient", j.server, j.room, "Error while reading from websocket", err)
-					goto reconnect
-				}
+	reconnect:
+		// Reset session state so rejoining sends fresh presence rather
+		// than assuming we're still joined.
+		j.session = jitsiSession{}
+		time.Sleep(1 * time.Second)
+		log.Println("JitsiClient", j.server, j.room, "Reconnecting...")
+	}
+}
 
-				err = xml.Unmarshal(msg, &v)
-				if err != nil {
-					// xml parsing errors will be normal here
-					continue
-				}
+var errJitsiShutdown = fmt.Errorf("shutting down")
 
-				if v.Nick.Text != "" { // if presence event has Nick present, it *shouldn't* mean that user has left the chat
-					if v.X.Item.Jid != "" {
-						if knownNick, ok := j.users[v.X.Item.Jid]; ok {
-							if knownNick != v.Nick.Text { // user changed nickname, we don't care about that enough
-                                log.Println("JitsiClient", j.server, j.room, "User changed nickname:", knownNick, v.Nick.Text)
-								j.users[v.X.Item.Jid] = v.Nick.Text
-								continue
-							}
-						} else { // new user
-							j.users[v.X.Item.Jid] = v.Nick.Text
-							nickZws := v.Nick.Text[:1] + "\u200B" + v.Nick.Text[1:]
-							ircMsg := fmt.Sprintf("NOTICE %s :jitsi: +%s\n", j.ircChannel, nickZws)
-                            log.Println("JitsiClient", j.server, j.room, "User joined:", j.users[v.X.Item.Jid])
-							c.Write(ircMsg)
-							continue
-						}
-					}
-				}
-				if v.Type == "unavailable" {
-					if v.X.Item.Jid != "" {
-						if knownNick, ok := j.users[v.X.Item.Jid]; ok {
-							delete(j.users, v.X.Item.Jid)
-							nickZws := knownNick[:1] + "\u200B" + knownNick[1:]
-							ircMsg := fmt.Sprintf("NOTICE %s :jitsi: -%s\n", j.ircChannel, nickZws)
-                            log.Println("JitsiClient", j.server, j.room, "User left:", knownNick)
-							c.Write(ircMsg)
-							continue
-						}
-					}
+// readStanzas decodes one top-level stanza at a time from ws and dispatches it by local name.
+func (j *JitsiClient) readStanzas(ws *websocket.Conn, n Notifier, done chan bool) error {
+	dec := xml.NewDecoder(ws)
+
+	for {
+		select {
+		case <-done:
+			log.Println("JitsiClient", j.server, j.room, "Shutting down")
+			return errJitsiShutdown
+		default:
+		}
+
+		tok, err := dec.Token()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		switch start.Name.Local {
+		case "presence":
+			var v JitsiPresence
+			if err := dec.DecodeElement(&v, &start); err != nil {
+				log.Println("JitsiClient", j.server, j.room, "Error decoding presence", err)
+				continue
+			}
+			j.handlePresence(&v, n)
+		case "message":
+			var v jitsiMessage
+			if err := dec.DecodeElement(&v, &start); err != nil {
+				log.Println("JitsiClient", j.server, j.room, "Error decoding message", err)
+				continue
+			}
+			log.Println("JitsiClient", j.server, j.room, "Message from", v.From, ":", v.Body)
+		case "iq":
+			var v jitsiIQ
+			if err := dec.DecodeElement(&v, &start); err != nil {
+				log.Println("JitsiClient", j.server, j.room, "Error decoding iq", err)
+				continue
+			}
+			log.Println("JitsiClient", j.server, j.room, "IQ", v.Type, "from", v.From, "id", v.ID)
+		case "features":
+			if err := dec.Skip(); err != nil {
+				return err
+			}
+		case "failure":
+			if err := dec.Skip(); err != nil {
+				return err
+			}
+			return fmt.Errorf("server reported stream failure")
+		case "success":
+			if err := dec.Skip(); err != nil {
+				return err
+			}
+			log.Println("JitsiClient", j.server, j.room, "Authenticated")
+		default:
+			if err := dec.Skip(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// handlePresence updates either the conference MUC's user list or, for
+// presence from the brewery MUC, just the tracked focus occupant.
+func (j *JitsiClient) handlePresence(v *JitsiPresence, n Notifier) {
+	if strings.HasPrefix(v.From, j.session.focusJID+"/") {
+		j.handleFocusPresence(v)
+		return
+	}
+
+	if v.Nick.Text != "" { // if presence event has Nick present, it *shouldn't* mean that user has left the chat
+		if v.X.Item.Jid != "" {
+			if knownNick, ok := j.users[v.X.Item.Jid]; ok {
+				if knownNick != v.Nick.Text { // user changed nickname, we don't care about that enough
+					log.Println("JitsiClient", j.server, j.room, "User changed nickname:", knownNick, v.Nick.Text)
+					j.users[v.X.Item.Jid] = v.Nick.Text
+					j.persistUsers()
 				}
+				return
 			}
+			// new user
+			j.users[v.X.Item.Jid] = v.Nick.Text
+			log.Println("JitsiClient", j.server, j.room, "User joined:", j.users[v.X.Item.Jid])
+			j.notifyPresence()
+			j.persistUsers()
+			return
 		}
-	reconnect:
-		time.Sleep(1 * time.Second)
-		log.Println("JitsiClient", j.server, j.room, "Reconnecting...")
+	}
+
+	if v.Type == "unavailable" {
+		if v.X.Item.Jid != "" {
+			if knownNick, ok := j.users[v.X.Item.Jid]; ok {
+				delete(j.users, v.X.Item.Jid)
+				log.Println("JitsiClient", j.server, j.room, "User left:", knownNick)
+				j.notifyPresence()
+				j.persistUsers()
+			}
+		}
+	}
+}
+
+// notifyPresence ticks j.tracker after a join or leave has been applied to j.users.
+func (j *JitsiClient) notifyPresence() {
+	if err := j.tracker.Tick(context.Background()); err != nil {
+		log.Println("JitsiClient", j.server, j.room, "Error reporting presence", err)
+	}
+}
+
+func (j *JitsiClient) handleFocusPresence(v *JitsiPresence) {
+	if v.Type == "unavailable" {
+		if v.Nick.Text == j.focusNick {
+			j.focusNick = ""
+		}
+		return
+	}
+
+	if v.Nick.Text != "" && v.Nick.Text != j.focusNick {
+		log.Println("JitsiClient", j.server, j.room, "Focus assigned:", v.Nick.Text)
+		j.focusNick = v.Nick.Text
 	}
 }
 
-func JitsiRunWrapper(c *irc.Client, done chan bool) {
+func JitsiRunWrapper(n Notifier, done chan bool) {
 	jitsiDone := make([]chan bool, len(jitsiChannels))
 
 	for i, ch := range jitsiChannels {
@@ -198,13 +485,13 @@ func JitsiRunWrapper(c *irc.Client, done chan bool) {
 		}
 
 		j := JitsiClient{
-            nick: nickname,
-            ircChannel: args[0],
-            server: args[1],
-            room: args[2],
-        }
+			nick:       nickname,
+			ircChannel: args[0],
+			server:     args[1],
+			room:       args[2],
+		}
 
-		go j.Run(c, jitsiDone[i])
+		go j.Run(n, jitsiDone[i])
 	}
 
 	<-done
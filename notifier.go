@@ -3,18 +3,26 @@ package main
 import (
 	"flag"
 	"log"
-	"net"
+	"math/rand"
+	"os"
+	"time"
 
+	"github.com/arachnist/notbot/brain"
 	"gopkg.in/irc.v3"
 )
 
 var (
-	channels arrayFlags
-	server   string
-	nickname string
-	password string
-	user     string
-	name     string
+	channels  arrayFlags
+	server    string
+	nickname  string
+	password  string
+	user      string
+	name      string
+	stateFile string
+
+	presenceDebounce int
+
+	state *brain.Brain
 )
 
 func init() {
@@ -24,37 +32,135 @@ func init() {
 	flag.StringVar(&user, "user", "bot", "Bot user parameter")
 	flag.StringVar(&name, "name", "bot notbot", "Bot real name parameter")
 	flag.Var(&channels, "channels", "Channel to join; may be specified multiple times")
+	flag.StringVar(&stateFile, "state.file", "notbot.state.json", "File monitors persist their state to across restarts")
+	flag.IntVar(&presenceDebounce, "presence.debounce", 1, "Consecutive ticks a name must flip before at/spaceapi/jitsi presence monitors report it; 1 reports immediately")
+
+	Dispatchers.Add(registrationWatcher)
+}
+
+// registered receives a value each time the client sees 001, so
+// runSupervised only resets its backoff once registration has succeeded.
+var registered = make(chan struct{}, 1)
+
+func registrationWatcher(_ *irc.Client, m *irc.Message) {
+	if m.Command == "001" {
+		select {
+		case registered <- struct{}{}:
+		default:
+		}
+	}
 }
 
 func main() {
+	// `notbot state` is a standalone subcommand, not the bot itself, so it
+	// must be dispatched before flag.Parse() claims os.Args.
+	if len(os.Args) > 1 && os.Args[1] == "state" {
+		runStateSubcommand(os.Args[2:])
+		return
+	}
+
 	done := make([]chan bool, len(Runners.list))
 
 	flag.Parse()
 
-	conn, err := net.Dial("tcp", server)
+	var err error
+	state, err = brain.New(stateFile)
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	config := irc.ClientConfig{
-		Nick:    nickname,
-		Pass:    password,
-		User:    user,
-		Name:    name,
-		Handler: irc.HandlerFunc(handlerFactory(Dispatchers.list)),
-	}
-
-	client := irc.NewClient(conn, config)
+	// ircN.client is updated on every (re)connect below; Runners hold onto
+	// the Notifier wrapping it for the whole process lifetime, so a
+	// reconnect never requires restarting them.
+	ircN := &ircNotifier{}
+	notifier := buildNotifier(ircN)
 
 	for i, runner := range Runners.list {
-		go runner(client, done[i])
+		go runner(notifier, done[i])
 	}
 
-	err = client.Run()
-	if err != nil {
-		for _, ch := range done {
-			ch <- true
+	runSupervised(ircN)
+}
+
+// maxBackoff caps how long runSupervised waits between reconnect attempts.
+const maxBackoff = 5 * time.Minute
+
+// runSupervised dials, registers, and runs the IRC client forever, instead
+// of giving up on the first disconnect. Every reconnect re-runs CAP/SASL
+// negotiation and, via joiner reacting to the fresh 001, rejoins every
+// channel from -channels again.
+func runSupervised(ircN *ircNotifier) {
+	backoff := time.Second
+
+	for {
+		conn, err := dial(server)
+		if err != nil {
+			log.Println("connecting:", err)
+			backoff = sleepBackoff(backoff)
+			continue
 		}
-		log.Fatalln(err)
+
+		config := irc.ClientConfig{
+			Nick:    nickname,
+			Pass:    password,
+			User:    user,
+			Name:    name,
+			Handler: irc.HandlerFunc(handlerFactory(Dispatchers.list)),
+		}
+
+		client := irc.NewClient(conn, config)
+
+		// CAP LS must reach the server before the client library's own
+		// registration burst (PASS/NICK/USER), so capDispatcher can
+		// negotiate capabilities and SASL before registration completes.
+		client.Write("CAP LS 302")
+
+		ircN.setClient(client)
+
+		// Drain any stale signal from a previous connection before
+		// watching for this one's 001.
+		select {
+		case <-registered:
+		default:
+		}
+
+		runErr := make(chan error, 1)
+		go func() { runErr <- client.Run() }()
+
+		select {
+		case <-registered:
+			// Registration succeeded, so this connection is worth
+			// resetting the backoff for; keep waiting for it to end.
+			backoff = time.Second
+			if err := <-runErr; err != nil {
+				log.Println("disconnected:", err)
+			}
+		case err := <-runErr:
+			// Disconnected before ever registering (bad SASL creds,
+			// K-line, nick collision, ...); don't reward that with a
+			// reset backoff, or a rejecting server gets hammered.
+			if err != nil {
+				log.Println("disconnected:", err)
+			}
+		}
+
+		// A nil client tells monitors to skip their tick rather than
+		// write to (or crash on) a dead connection while we're down.
+		ircN.setClient(nil)
+		backoff = sleepBackoff(backoff)
+	}
+}
+
+// sleepBackoff sleeps for a jittered fraction of current, then returns the
+// next backoff to use, doubling up to maxBackoff.
+func sleepBackoff(current time.Duration) time.Duration {
+	jitter := time.Duration(rand.Int63n(int64(current)))
+	time.Sleep(current/2 + jitter/2)
+
+	next := current * 2
+	if next > maxBackoff {
+		next = maxBackoff
 	}
+
+	return next
 }
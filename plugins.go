@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"sync"
 
@@ -20,7 +21,70 @@ func (d *dispatchers) Add(f dispatchFunc) {
 	d.list = append(d.list, f)
 }
 
-type runFunc func(c *irc.Client, done chan bool)
+// Notifier is how monitors publish their arrived/left diffs without needing
+// to know whether they're talking to IRC, XMPP, or both at once.
+type Notifier interface {
+	Notice(target, text string)
+	Available() bool
+}
+
+// ircNotifier sends Notice calls as IRC NOTICEs. Its client is swapped out
+// with setClient on every reconnect, so the supervisor can keep handing it
+// a fresh *irc.Client without Runners ever needing to be restarted.
+type ircNotifier struct {
+	lock   sync.Mutex
+	client *irc.Client
+}
+
+func (n *ircNotifier) setClient(c *irc.Client) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.client = c
+}
+
+func (n *ircNotifier) Notice(target, text string) {
+	n.lock.Lock()
+	c := n.client
+	n.lock.Unlock()
+
+	if c == nil {
+		return
+	}
+
+	c.Write(fmt.Sprintf("NOTICE %s :%s", target, text))
+}
+
+func (n *ircNotifier) Available() bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	return n.client != nil
+}
+
+// multiNotifier mirrors every Notice to each of its backends, so a target
+// configured for both IRC and XMPP gets the same event on both.
+type multiNotifier struct {
+	backends []Notifier
+}
+
+func (n *multiNotifier) Notice(target, text string) {
+	for _, backend := range n.backends {
+		backend.Notice(target, text)
+	}
+}
+
+func (n *multiNotifier) Available() bool {
+	for _, backend := range n.backends {
+		if backend.Available() {
+			return true
+		}
+	}
+
+	return false
+}
+
+type runFunc func(n Notifier, done chan bool)
 type runners struct {
 	lock sync.Mutex
 	list []runFunc
@@ -51,6 +115,9 @@ func logger(_ *irc.Client, m *irc.Message) {
 }
 
 func joiner(c *irc.Client, m *irc.Message) {
+	// 903 fires before CAP END, i.e. before registration completes, so
+	// joining on it gets JOIN rejected with ERR_NOTREGISTERED. 001 is
+	// still the right trigger regardless of SASL.
 	if m.Command == "001" {
 		for _, ch := range channels {
 			c.Write("JOIN " + ch)
@@ -0,0 +1,213 @@
+// Package presence tracks who's present at a target and reports
+// arrived/left/also-there diffs through an Emitter.
+package presence
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Source fetches the current set of names present at a target.
+type Source interface {
+	Fetch(ctx context.Context) ([]string, error)
+}
+
+// Emitter reports a presence diff for target, e.g. as an IRC NOTICE.
+type Emitter interface {
+	Notice(target, text string)
+}
+
+// availabilityChecker lets Tick skip fetching through an Emitter that has
+// nowhere to send to right now; Emitters that don't implement it always
+// tick.
+type availabilityChecker interface {
+	Available() bool
+}
+
+// Tracker diffs a Source against its last-known state and reports
+// arrived/left/also-there through an Emitter.
+type Tracker struct {
+	target   string
+	source   Source
+	emitter  Emitter
+	interval time.Duration
+	debounce int
+
+	// OnTick, if set, is called after every tick that completed without
+	// error, so callers can persist the tracker's state or feed it to a
+	// derived view without duplicating Run's loop themselves.
+	OnTick func(current []string)
+
+	// OnError, if set, is called instead of the error being dropped when
+	// a tick's Fetch fails.
+	OnError func(error)
+
+	current []string
+	pending map[string]int
+}
+
+// New builds a Tracker. debounce is how many consecutive ticks a name must
+// appear on the opposite side before being reported arrived or left; 0 or 1
+// reports on the first tick it's noticed.
+func New(target string, source Source, emitter Emitter, interval time.Duration, debounce int) *Tracker {
+	return &Tracker{
+		target:   target,
+		source:   source,
+		emitter:  emitter,
+		interval: interval,
+		debounce: debounce,
+		pending:  map[string]int{},
+	}
+}
+
+// Seed sets the tracker's last-known state without emitting a diff for it.
+func (t *Tracker) Seed(names []string) {
+	t.current = append([]string(nil), names...)
+}
+
+// Current returns a copy of the tracker's last-known present set.
+func (t *Tracker) Current() []string {
+	return append([]string(nil), t.current...)
+}
+
+// Run ticks the tracker on its own interval until ctx is done. Callers that
+// already own a ticker loop can call Tick directly instead.
+func (t *Tracker) Run(ctx context.Context) {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := t.Tick(ctx); err != nil && t.OnError != nil {
+				t.OnError(err)
+			}
+		}
+	}
+}
+
+// Tick fetches the source once, debounces the result against the tracker's
+// state, and emits a diff if anything survived debouncing.
+func (t *Tracker) Tick(ctx context.Context) error {
+	if avail, ok := t.emitter.(availabilityChecker); ok && !avail.Available() {
+		return nil
+	}
+
+	fetched, err := t.source.Fetch(ctx)
+	if err != nil {
+		return fmt.Errorf("fetching presence for %s: %w", t.target, err)
+	}
+
+	previous := t.Current()
+
+	arrived, left := t.debounceDiff(fetched)
+	alsoThere := subtract(previous, left)
+
+	sort.Strings(arrived)
+	sort.Strings(left)
+	sort.Strings(alsoThere)
+
+	if len(arrived) > 0 || len(left) > 0 {
+		var diffText string
+		if len(arrived) > 0 {
+			diffText = fmt.Sprint(" arrived: ", arrived)
+		}
+		if len(left) > 0 {
+			diffText += fmt.Sprint(" left: ", left)
+		}
+		if len(alsoThere) > 0 {
+			diffText += fmt.Sprint(" also there: ", alsoThere)
+		}
+
+		t.emitter.Notice(t.target, diffText)
+	}
+
+	if t.OnTick != nil {
+		t.OnTick(t.Current())
+	}
+
+	return nil
+}
+
+// debounceDiff updates t.current to fetched (once names have survived
+// debouncing) and returns the names that just arrived or just left.
+func (t *Tracker) debounceDiff(fetched []string) (arrived, left []string) {
+	fetchedSet := make(map[string]bool, len(fetched))
+	for _, name := range fetched {
+		fetchedSet[name] = true
+	}
+
+	currentSet := make(map[string]bool, len(t.current))
+	for _, name := range t.current {
+		currentSet[name] = true
+	}
+
+	threshold := t.debounce
+	if threshold < 1 {
+		threshold = 1
+	}
+
+	var next []string
+
+	for _, name := range t.current {
+		if fetchedSet[name] {
+			delete(t.pending, name)
+			next = append(next, name)
+			continue
+		}
+
+		t.pending[name]++
+		if t.pending[name] >= threshold {
+			left = append(left, name)
+			delete(t.pending, name)
+			continue
+		}
+
+		next = append(next, name) // still counted present until debounce elapses
+	}
+
+	for _, name := range fetched {
+		if currentSet[name] {
+			continue
+		}
+
+		t.pending[name]++
+		if t.pending[name] >= threshold {
+			arrived = append(arrived, name)
+			next = append(next, name)
+			delete(t.pending, name)
+		}
+	}
+
+	// Evict arrival candidates that didn't show up this tick, symmetric
+	// with how the leaving side resets above, so debounce means N
+	// consecutive ticks rather than N sightings ever.
+	for name := range t.pending {
+		if !currentSet[name] && !fetchedSet[name] {
+			delete(t.pending, name)
+		}
+	}
+
+	t.current = next
+
+	return arrived, left
+}
+
+func subtract(a, b []string) (ret []string) {
+	inB := make(map[string]bool, len(b))
+	for _, x := range b {
+		inB[x] = true
+	}
+
+	for _, x := range a {
+		if !inB[x] {
+			ret = append(ret, x)
+		}
+	}
+
+	return ret
+}
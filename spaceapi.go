@@ -1,15 +1,15 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
-	"sort"
 	"strings"
 	"time"
 
-	"gopkg.in/irc.v3"
+	"github.com/arachnist/notbot/presence"
 )
 
 var (
@@ -17,11 +17,12 @@ var (
 )
 
 type spaceApiResponse struct {
-	API      string `json:"api"`
-	Space    string `json:"space"`
-	Logo     string `json:"logo"`
-	URL      string `json:"url"`
-	Location struct {
+	API              string   `json:"api"`
+	APICompatibility []string `json:"api_compatibility,omitempty"`
+	Space            string   `json:"space"`
+	Logo             string   `json:"logo"`
+	URL              string   `json:"url"`
+	Location         struct {
 		Lat     float64 `json:"lat"`
 		Lon     float64 `json:"lon"`
 		Address string  `json:"address"`
@@ -67,7 +68,7 @@ type spaceApiResponse struct {
 func (s *spaceApiResponse) UserListZWS() (ret []string) {
 	for _, room := range s.Sensors.PeopleNowPresent {
 		for _, user := range room.Names {
-			login := user[:1] + "\u200B" + user[1:]
+			login := user[:1] + "​" + user[1:]
 			ret = append(ret, login)
 		}
 	}
@@ -78,71 +79,72 @@ func (s *spaceApiResponse) UserListZWS() (ret []string) {
 type spaceApiClient struct {
 	ircChannel string
 	apiUrl     string
-	users      []string
 }
 
-func (s *spaceApiClient) Run(c *irc.Client, done chan bool) {
-	ticker := time.NewTicker(10 * time.Second)
-
-	for {
-		select {
-		case <-done:
-			return
-		case <-ticker.C:
-			var diffText string
-			response, err := s.currentState()
-
-			if err != nil {
-				log.Println(err)
-				break
-			}
+func (s *spaceApiClient) stateKey() string {
+	return "spaceapi." + s.ircChannel
+}
 
-			current := response.UserListZWS()
+// spaceApiPresenceSource fetches a downstream SpaceAPI endpoint for a
+// presence.Tracker.
+type spaceApiPresenceSource struct {
+	apiUrl string
+}
 
-			arrived := listSubtract(current, s.users)
-			left := listSubtract(s.users, current)
-			alsoThere := listSubtract(s.users, left)
-			sort.Strings(alsoThere)
+func (s spaceApiPresenceSource) Fetch(ctx context.Context) ([]string, error) {
+	data, err := httpGet(s.apiUrl)
+	if err != nil {
+		return nil, fmt.Errorf("unable to access spaceApi: %w", err)
+	}
 
-			if len(arrived) > 0 {
-				diffText = fmt.Sprint(" arrived: ", arrived)
-			}
+	var values spaceApiResponse
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, fmt.Errorf("unable to decode spaceApi response: %w", err)
+	}
 
-			if len(left) > 0 {
-				diffText += fmt.Sprint(" left: ", left)
-			}
+	return values.UserListZWS(), nil
+}
 
-			if len(diffText) > 0 {
-				if len(alsoThere) > 0 {
-					diffText += fmt.Sprint(" also there: ", alsoThere)
-				}
+func (s *spaceApiClient) Run(n Notifier, done chan bool) {
+	tracker := presence.New(s.ircChannel, spaceApiPresenceSource{apiUrl: s.apiUrl}, n, 10*time.Second, presenceDebounce)
 
-				msg := fmt.Sprintf("NOTICE %s :%s\n", s.ircChannel, diffText)
-				log.Println(diffText)
-				c.Write(msg)
-				s.users = current
+	if state != nil {
+		if raw, ok := state.Retrieve(s.stateKey()); ok {
+			var previous []string
+			if err := json.Unmarshal(raw, &previous); err != nil {
+				log.Println("spaceapi: decoding previous state:", err)
+			} else {
+				tracker.Seed(previous)
 			}
 		}
 	}
-}
-
-func (s *spaceApiClient) currentState() (at spaceApiResponse, err error) {
-	var values spaceApiResponse = spaceApiResponse{}
 
-	data, err := httpGet(s.apiUrl)
-	if err != nil {
-		return values, fmt.Errorf("Unable to access spaceApi:", err)
+	tracker.OnError = func(err error) {
+		log.Println("spaceapi:", err)
 	}
 
-	err = json.Unmarshal(data, &values)
-	if err != nil {
-		return values, fmt.Errorf("Unable to decode spaceApi response:", err)
+	tracker.OnTick = func(current []string) {
+		aggregate.set(s.ircChannel, current)
+
+		if state != nil {
+			if raw, err := json.Marshal(current); err != nil {
+				log.Println("spaceapi: encoding state:", err)
+			} else {
+				state.Store(s.stateKey(), raw)
+			}
+		}
 	}
 
-	return values, nil
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-done
+		cancel()
+	}()
+
+	tracker.Run(ctx)
 }
 
-func spaceApiRunWrapper(c *irc.Client, done chan bool) {
+func spaceApiRunWrapper(n Notifier, done chan bool) {
 	spaceApiDone := make([]chan bool, len(spaceApiChannels))
 
 	for i, ch := range spaceApiChannels {
@@ -156,7 +158,7 @@ func spaceApiRunWrapper(c *irc.Client, done chan bool) {
 			apiUrl:     args[1],
 		}
 
-		go s.Run(c, spaceApiDone[i])
+		go s.Run(n, spaceApiDone[i])
 	}
 
 	<-done
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+)
+
+var (
+	spaceApiListen        string
+	spaceApiSpaceName     string
+	spaceApiLogo          string
+	spaceApiHomepage      string
+	spaceApiAddress       string
+	spaceApiLat           float64
+	spaceApiLon           float64
+	spaceApiSource        string
+	spaceApiOpenThreshold int
+)
+
+func init() {
+	flag.StringVar(&spaceApiListen, "spaceapi.listen", "", "Address to serve an aggregated SpaceAPI v14 endpoint on; empty disables it")
+	flag.StringVar(&spaceApiSpaceName, "spaceapi.space", "Hackerspace", "SpaceAPI space name")
+	flag.StringVar(&spaceApiLogo, "spaceapi.logo", "", "SpaceAPI logo URL")
+	flag.StringVar(&spaceApiHomepage, "spaceapi.url", "", "SpaceAPI homepage URL")
+	flag.StringVar(&spaceApiAddress, "spaceapi.address", "", "SpaceAPI location address")
+	flag.Float64Var(&spaceApiLat, "spaceapi.lat", 0, "SpaceAPI location latitude")
+	flag.Float64Var(&spaceApiLon, "spaceapi.lon", 0, "SpaceAPI location longitude")
+	flag.StringVar(&spaceApiSource, "spaceapi.source", "", "ircChannel whose presence list is authoritative for the aggregated endpoint")
+	flag.IntVar(&spaceApiOpenThreshold, "spaceapi.open-threshold", 1, "Minimum people present for the space to be reported as open")
+
+	Runners.Add(spaceApiServerRunner)
+}
+
+// aggregate holds the -spaceapi.source channel's current presence list, fed
+// by atMonitor and spaceApiClient every tick.
+var aggregate presenceRegistry
+
+type presenceRegistry struct {
+	lock  sync.Mutex
+	names []string
+}
+
+func (p *presenceRegistry) set(channel string, names []string) {
+	if spaceApiSource == "" || channel != spaceApiSource {
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.names = names
+}
+
+func (p *presenceRegistry) get() []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return append([]string(nil), p.names...)
+}
+
+// aggregatedResponse reuses spaceApiResponse as the shape of this bot's own
+// v14-compatible endpoint.
+func aggregatedResponse() spaceApiResponse {
+	var resp spaceApiResponse
+
+	resp.APICompatibility = []string{"14"}
+	resp.Space = spaceApiSpaceName
+	resp.Logo = spaceApiLogo
+	resp.URL = spaceApiHomepage
+	resp.Location.Address = spaceApiAddress
+	resp.Location.Lat = spaceApiLat
+	resp.Location.Lon = spaceApiLon
+
+	names := aggregate.get()
+	resp.State.Open = len(names) >= spaceApiOpenThreshold
+
+	resp.Sensors.PeopleNowPresent = append(resp.Sensors.PeopleNowPresent, struct {
+		Value int      `json:"value"`
+		Names []string `json:"names"`
+	}{Value: len(names), Names: names})
+
+	return resp
+}
+
+func spaceApiServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(aggregatedResponse()); err != nil {
+		log.Println("spaceapi: encoding response:", err)
+	}
+}
+
+// spaceApiServerRunner is a Runner that owns an HTTP server instead of
+// polling anything; -spaceapi.listen empty disables it.
+func spaceApiServerRunner(n Notifier, done chan bool) {
+	if spaceApiListen == "" {
+		<-done
+		return
+	}
+
+	srv := &http.Server{Addr: spaceApiListen, Handler: http.HandlerFunc(spaceApiServeHTTP)}
+
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Println("spaceapi: server error:", err)
+		}
+	}()
+
+	<-done
+	srv.Close()
+}
+
+// runStateSubcommand implements `notbot state`, a small standalone client
+// for scripts that just want an open/closed exit status without parsing
+// JSON themselves.
+func runStateSubcommand(args []string) {
+	fs := flag.NewFlagSet("state", flag.ExitOnError)
+	endpoint := fs.String("url", "http://localhost:8080/", "Aggregated SpaceAPI endpoint to query")
+	fs.Parse(args)
+
+	resp, err := http.Get(*endpoint)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer resp.Body.Close()
+
+	var status spaceApiResponse
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		log.Fatalln(err)
+	}
+
+	if status.State.Open {
+		fmt.Println("open")
+		return
+	}
+
+	fmt.Println("closed")
+	os.Exit(1)
+}
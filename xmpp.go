@@ -0,0 +1,291 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	xmppJID      string
+	xmppPassword string
+	xmppResource string
+	xmppMUCs     arrayFlags
+)
+
+func init() {
+	flag.StringVar(&xmppJID, "xmpp.jid", "", "XMPP bot JID (user@server); empty disables the XMPP notifier")
+	flag.StringVar(&xmppPassword, "xmpp.password", "", "XMPP bot password")
+	flag.StringVar(&xmppResource, "xmpp.resource", "notbot", "XMPP resource to bind")
+	flag.Var(&xmppMUCs, "xmpp.muc", "ircChannel,mucJid mapping; may be specified multiple times")
+}
+
+// buildNotifier adds the XMPP MUC backend to the IRC one when -xmpp.jid is
+// set; otherwise IRC alone is returned.
+func buildNotifier(irc *ircNotifier) Notifier {
+	backends := []Notifier{irc}
+
+	if xmppJID != "" {
+		mucs, err := parseMUCMappings(xmppMUCs)
+		if err != nil {
+			log.Fatalln("xmpp:", err)
+		}
+
+		x := &xmppNotifier{
+			jid:      xmppJID,
+			password: xmppPassword,
+			resource: xmppResource,
+			mucs:     mucs,
+		}
+
+		go x.run()
+
+		backends = append(backends, x)
+	}
+
+	return &multiNotifier{backends: backends}
+}
+
+func parseMUCMappings(flags arrayFlags) (map[string]string, error) {
+	mucs := map[string]string{}
+
+	for _, mapping := range flags {
+		args := strings.SplitN(mapping, ",", 2)
+		if len(args) != 2 {
+			return nil, fmt.Errorf("wrong -xmpp.muc mapping format: %q", mapping)
+		}
+
+		mucs[args[0]] = args[1]
+	}
+
+	return mucs, nil
+}
+
+// xmppNotifier sends Notice calls as groupchat messages to mapped MUCs, over
+// a bare TLS stream with hand-rolled stanzas.
+type xmppNotifier struct {
+	jid      string
+	password string
+	resource string
+	mucs     map[string]string // ircChannel -> muc JID
+
+	lock sync.Mutex
+	conn net.Conn
+}
+
+func (x *xmppNotifier) host() string {
+	if i := strings.IndexByte(x.jid, '@'); i >= 0 {
+		return x.jid[i+1:]
+	}
+	return x.jid
+}
+
+func (x *xmppNotifier) setConn(conn net.Conn) {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	x.conn = conn
+}
+
+func (x *xmppNotifier) Available() bool {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	return x.conn != nil
+}
+
+func (x *xmppNotifier) write(stanza string) error {
+	x.lock.Lock()
+	conn := x.conn
+	x.lock.Unlock()
+
+	if conn == nil {
+		return fmt.Errorf("xmpp: not connected")
+	}
+
+	_, err := conn.Write([]byte(stanza))
+	return err
+}
+
+// run reconnects with a fixed backoff on any error.
+func (x *xmppNotifier) run() {
+	for {
+		if err := x.connect(); err != nil {
+			log.Println("xmpp: connection error:", err)
+			x.setConn(nil)
+			time.Sleep(15 * time.Second)
+			continue
+		}
+	}
+}
+
+// openStream writes a fresh <stream:stream> and reads up to (and including)
+// the <stream:features/> the server sends in response, per RFC 6120
+// §4.3/§6.4.6: a client must restart the stream after SASL success instead
+// of reusing the pre-auth one, so this is called twice per connection.
+func (x *xmppNotifier) openStream(conn net.Conn, dec *xml.Decoder) error {
+	opening := fmt.Sprintf("<stream:stream to='%s' version='1.0' xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams'>", x.host())
+	if _, err := conn.Write([]byte(opening)); err != nil {
+		return fmt.Errorf("opening stream: %w", err)
+	}
+
+	start, err := nextStanza(dec)
+	if err != nil {
+		return fmt.Errorf("reading stream features: %w", err)
+	}
+	if start.Name.Local != "features" {
+		return fmt.Errorf("expected stream features, got %s", start.Name.Local)
+	}
+
+	return dec.Skip()
+}
+
+func (x *xmppNotifier) connect() error {
+	conn, err := tls.Dial("tcp", x.host()+":5223", &tls.Config{ServerName: x.host()})
+	if err != nil {
+		return fmt.Errorf("dialing %s: %w", x.host(), err)
+	}
+	defer conn.Close()
+
+	dec := xml.NewDecoder(conn)
+
+	if err := x.openStream(conn, dec); err != nil {
+		return err
+	}
+
+	user := x.jid
+	if i := strings.IndexByte(user, '@'); i >= 0 {
+		user = user[:i]
+	}
+	authPayload := base64.StdEncoding.EncodeToString([]byte("\x00" + user + "\x00" + x.password))
+	authFrame := fmt.Sprintf("<auth mechanism='PLAIN' xmlns='urn:ietf:params:xml:ns:xmpp-sasl'>%s</auth>", authPayload)
+	if _, err := conn.Write([]byte(authFrame)); err != nil {
+		return fmt.Errorf("authenticating: %w", err)
+	}
+
+	start, err := nextStanza(dec)
+	if err != nil {
+		return fmt.Errorf("reading SASL result: %w", err)
+	}
+	if err := dec.Skip(); err != nil {
+		return fmt.Errorf("reading SASL result: %w", err)
+	}
+	if start.Name.Local != "success" {
+		return fmt.Errorf("xmpp: authentication failed (%s)", start.Name.Local)
+	}
+
+	// Successful SASL invalidates the pre-auth stream; negotiate a new one
+	// before binding a resource on it.
+	if err := x.openStream(conn, dec); err != nil {
+		return err
+	}
+
+	bindFrame := fmt.Sprintf("<iq type='set' id='bind1'><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'><resource>%s</resource></bind></iq>", x.resource)
+	if _, err := conn.Write([]byte(bindFrame)); err != nil {
+		return fmt.Errorf("binding resource: %w", err)
+	}
+
+	start, err = nextStanza(dec)
+	if err != nil {
+		return fmt.Errorf("reading bind result: %w", err)
+	}
+	var bindResult struct {
+		XMLName xml.Name `xml:"iq"`
+		Type    string   `xml:"type,attr"`
+	}
+	if err := dec.DecodeElement(&bindResult, &start); err != nil {
+		return fmt.Errorf("reading bind result: %w", err)
+	}
+	if bindResult.Type != "result" {
+		return fmt.Errorf("xmpp: binding resource failed (%s)", bindResult.Type)
+	}
+
+	x.setConn(conn)
+	log.Println("xmpp: connected as", x.jid)
+
+	go x.keepAlive(conn)
+
+	nick := nickname
+	for ircChannel, muc := range x.mucs {
+		presence := fmt.Sprintf("<presence to='%s/%s'/>", muc, nick)
+		if _, err := conn.Write([]byte(presence)); err != nil {
+			return fmt.Errorf("joining %s for %s: %w", muc, ircChannel, err)
+		}
+	}
+
+	for {
+		start, err := nextStanza(dec)
+		if err != nil {
+			return fmt.Errorf("reading stream: %w", err)
+		}
+		if err := dec.Skip(); err != nil {
+			return fmt.Errorf("reading stream: %w", err)
+		}
+		log.Println("xmpp: received", start.Name.Local)
+	}
+}
+
+// nextStanza returns the next top-level stanza, transparently skipping the
+// <stream:stream> open tag itself: unlike every other element it's never
+// closed for the life of the connection, so it can't be handled like one.
+func nextStanza(dec *xml.Decoder) (xml.StartElement, error) {
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return xml.StartElement{}, err
+		}
+
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		if start.Name.Local == "stream" {
+			continue
+		}
+
+		return start, nil
+	}
+}
+
+// keepAlive pings periodically so idle connections aren't dropped by the
+// server or an intermediate proxy.
+func (x *xmppNotifier) keepAlive(conn net.Conn) {
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if _, err := conn.Write([]byte(pingFrame)); err != nil {
+			return
+		}
+	}
+}
+
+// Notice sends text to whichever MUC is mapped to target; unmapped targets
+// are silently skipped.
+func (x *xmppNotifier) Notice(target, text string) {
+	muc, ok := x.mucs[target]
+	if !ok {
+		return
+	}
+
+	stanza := fmt.Sprintf("<message to='%s' type='groupchat'><body>%s</body></message>", muc, xmlEscape(text))
+	if err := x.write(stanza); err != nil {
+		log.Println("xmpp: sending notice:", err)
+	}
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	if err := xml.EscapeText(&b, []byte(s)); err != nil {
+		return s
+	}
+	return b.String()
+}